@@ -0,0 +1,191 @@
+/*
+  nscrestc
+
+  Copyright 2016 Michael Kraus <Michael.Kraus@consol.de>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Griesbacher/nscrestc/pkg/nsclient"
+)
+
+//batchQuery is one "command key=value ..." line from a -b batch file.
+type batchQuery struct {
+	command string
+	params  url.Values
+}
+
+//batchResult is the outcome of running a single batchQuery.
+type batchResult struct {
+	command  string
+	result   string
+	lines    []string
+	sourceID string
+	perfdata []Perfdata
+}
+
+//parseBatchFile reads one batchQuery per non-empty line of path.
+func parseBatchFile(path string) ([]batchQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []batchQuery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		queries = append(queries, batchQuery{command: fields[0], params: parseParams(fields[1:])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+//runBatch runs every query in batchFile over client, using parallel workers,
+//and prints a combined worst-case result the way a single query would.
+func runBatch(ctx context.Context, client *nsclient.Client, batchFile string, parallel int, output, promTextfile string, submitTarget *nrdpTarget) {
+	queries, err := parseBatchFile(batchFile)
+	if err != nil {
+		fmt.Println("UNKNOWN: " + err.Error())
+		os.Exit(3)
+	}
+	if len(queries) == 0 {
+		fmt.Println("UNKNOWN: Batch file " + batchFile + " contains no queries")
+		os.Exit(3)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]batchResult, len(queries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runBatchQuery(ctx, client, queries[i])
+			}
+		}()
+	}
+	for i := range queries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var combinedMessage []string
+	var combinedLines []string
+	var combinedPerfdata []Perfdata
+	var sourceID string
+	worst := "OK"
+	for _, r := range results {
+		combinedMessage = append(combinedMessage, r.command+": "+strings.Join(r.lines, "\n"))
+		for _, l := range r.lines {
+			combinedLines = append(combinedLines, r.command+": "+l)
+		}
+		combinedPerfdata = append(combinedPerfdata, r.perfdata...)
+		if sourceID == "" {
+			sourceID = r.sourceID
+		}
+		if ReturncodeMap[r.result] > ReturncodeMap[worst] {
+			worst = r.result
+		}
+	}
+	message := strings.Join(combinedMessage, "; ")
+
+	if promTextfile != "" {
+		if err := writePromTextfile(promTextfile, "", sourceID, combinedPerfdata); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
+		}
+	}
+
+	if submitTarget != nil {
+		perf := nagiosPerfString(combinedPerfdata)
+		submitOutput := message
+		if perf != "" {
+			submitOutput += "|" + perf
+		}
+		if err := submitTarget.submit(ctx, client.HTTPClient(), ReturncodeMap[worst], submitOutput); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
+		}
+		fmt.Println("OK: submitted " + worst + " result for " + submitTarget.hostname + " to NRDP")
+		os.Exit(0)
+	}
+
+	switch output {
+	case "json":
+		jsonResult := JSONResult{
+			Result:   worst,
+			ExitCode: ReturncodeMap[worst],
+			Message:  message,
+			Lines:    combinedLines,
+			Perfdata: combinedPerfdata,
+		}
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(jsonResult); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
+		}
+	default:
+		perf := nagiosPerfString(combinedPerfdata)
+		if perf == "" {
+			fmt.Println(message)
+		} else {
+			fmt.Println(message + "|" + perf)
+		}
+	}
+	os.Exit(ReturncodeMap[worst])
+}
+
+//runBatchQuery runs a single batchQuery and never fails the whole batch: a
+//per-query error is reported as that query's own UNKNOWN result.
+func runBatchQuery(ctx context.Context, client *nsclient.Client, q batchQuery) batchResult {
+	queryResult, err := client.Query(ctx, q.command, q.params)
+	if err != nil {
+		return batchResult{command: q.command, result: "UNKNOWN", lines: []string{err.Error()}}
+	}
+	lines, _, perfdata := renderResult(queryResult)
+	for i := range perfdata {
+		perfdata[i].Command = q.command
+	}
+	return batchResult{
+		command:  q.command,
+		result:   queryResult.Payload[0].Result,
+		lines:    lines,
+		sourceID: queryResult.Header.SourceID,
+		perfdata: perfdata,
+	}
+}
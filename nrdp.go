@@ -0,0 +1,137 @@
+/*
+  nscrestc
+
+  Copyright 2016 Michael Kraus <Michael.Kraus@consol.de>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//nrdpTarget is a parsed --submit=nrdp://host:port?token=...&host=...&service=... flag.
+type nrdpTarget struct {
+	endpoint string
+	token    string
+	hostname string
+	service  string
+}
+
+//parseNRDPTarget turns a nrdp:// (or nrdps://) URL into the NRDP endpoint to
+//POST to plus the token/hostname/servicename to submit under.
+func parseNRDPTarget(raw string) (*nrdpTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	switch u.Scheme {
+	case "nrdp":
+		scheme = "http"
+	case "nrdps":
+		scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported --submit scheme %q, expected nrdp:// or nrdps://", u.Scheme)
+	}
+
+	q := u.Query()
+	token := q.Get("token")
+	hostname := q.Get("host")
+	if token == "" || hostname == "" {
+		return nil, fmt.Errorf("--submit requires token and host query parameters")
+	}
+
+	endpoint := url.URL{Scheme: scheme, Host: u.Host, Path: "/nrdp/"}
+	return &nrdpTarget{
+		endpoint: endpoint.String(),
+		token:    token,
+		hostname: hostname,
+		service:  q.Get("service"),
+	}, nil
+}
+
+//nrdpCheckResult is a single <checkresult> as expected by NRDP's XMLDATA payload.
+type nrdpCheckResult struct {
+	XMLName     xml.Name `xml:"checkresult"`
+	Type        string   `xml:"type,attr"`
+	Hostname    string   `xml:"hostname"`
+	Servicename string   `xml:"servicename,omitempty"`
+	State       int      `xml:"state"`
+	Output      string   `xml:"output"`
+}
+
+//nrdpCheckResults is the <checkresults> document NRDP expects as XMLDATA.
+type nrdpCheckResults struct {
+	XMLName xml.Name          `xml:"checkresults"`
+	Results []nrdpCheckResult `xml:"checkresult"`
+}
+
+//submit POSTs state/output to the NRDP endpoint as a passive check result,
+//mirroring how other monitoring bridges (send_nsca, NSCA-ng) package an
+//active check result for upstream passive ingestion. It reuses httpClient
+//(the same *http.Client built for the NSClient++ query) so -k, -C/-K, -A,
+//--ciphers, --min-tls and -t all apply to the submission too.
+func (t *nrdpTarget) submit(ctx context.Context, httpClient *http.Client, state int, output string) error {
+	checkType := "host"
+	if t.service != "" {
+		checkType = "service"
+	}
+
+	doc := nrdpCheckResults{Results: []nrdpCheckResult{{
+		Type:        checkType,
+		Hostname:    t.hostname,
+		Servicename: t.service,
+		State:       state,
+		Output:      output,
+	}}}
+
+	xmlData, err := xml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"token":   {t.token},
+		"cmd":     {"submitcheck"},
+		"XMLDATA": {"<?xml version='1.0'?>" + string(xmlData)},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("NRDP submission failed with status %s: %s", res.Status, string(body))
+	}
+	return nil
+}
@@ -20,48 +20,277 @@
 package main
 
 // TODO
-// - specify cert
-// - specify ciphers
 // - usage header
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"net/http"
-	"net/http/httputil"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/Griesbacher/nscrestc/pkg/nsclient"
 )
 
-//Query represents the nsclient response
-type Query struct {
-	Header struct {
-		SourceID string `json:"source_id"`
-	} `json:"header"`
-	Payload []struct {
-		Command string `json:"command"`
-		Lines   []struct {
-			Message string `json:"message"`
-			Perf    []struct {
-				Alias    string `json:"alias"`
-				IntValue struct {
-					Value    *float64 `json:"value,omitempty"`
-					Unit     *string  `json:"unit,omitempty"`
-					Warning  *float64 `json:"warning,omitempty"`
-					Critical *float64 `json:"critical,omitempty"`
-					Minimum  *float64 `json:"mininum,omitempty"`
-					Maximum  *float64 `json:"maximum,omitempty"`
-				} `json:"int_value"`
-			} `json:"perf"`
-		} `json:"lines"`
-		Result string `json:"result"`
-	} `json:"payload"`
+//tlsVersions maps the --min-tls flag values to their tls.Config constants.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//cipherSuiteByName maps IANA cipher suite names to their tls.CipherSuite ID,
+//covering both the suites Go considers secure and the insecure ones it still
+//supports for compatibility with older peers.
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+//buildCipherSuites parses a comma-separated list of IANA cipher suite names.
+func buildCipherSuites(csv string) ([]uint16, error) {
+	var suites []uint16
+	for _, name := range strings.Split(csv, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuiteByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+//loadCABundle reads a PEM CA bundle file into a cert pool for RootCAs.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+//Perfdata is a single parsed perfdata entry, independent of the Nagios
+//plugin string representation so it can be re-serialized (e.g. to JSON).
+type Perfdata struct {
+	Alias    string   `json:"alias"`
+	Value    float64  `json:"value"`
+	Unit     string   `json:"unit,omitempty"`
+	Warning  *float64 `json:"warning,omitempty"`
+	Critical *float64 `json:"critical,omitempty"`
+	Minimum  *float64 `json:"minimum,omitempty"`
+	Maximum  *float64 `json:"maximum,omitempty"`
+	//Command is the query command that produced this entry. It is only
+	//populated in batch mode, where a single textfile/JSON document can
+	//hold perfdata from several different commands.
+	Command string `json:"command,omitempty"`
+}
+
+//JSONResult is the document emitted in "-o json" output mode. Message is
+//every response line joined with "\n" so multi-line NSClient++ output isn't
+//lost the way the single-line Nagios message|perfdata format loses it;
+//Lines holds the same text as individual, unjoined entries. In batch mode
+//Message is the combined "command: ..." message joined with "; ", and each
+//Lines entry is prefixed with the command that produced it.
+type JSONResult struct {
+	Result   string     `json:"result"`
+	ExitCode int        `json:"exit_code"`
+	Message  string     `json:"message"`
+	Lines    []string   `json:"lines"`
+	Perfdata []Perfdata `json:"perfdata"`
+}
+
+//ReturncodeMap maps the Nagios/NSClient++ result string to its plugin exit code.
+var ReturncodeMap = map[string]int{
+	"OK":       0,
+	"WARNING":  1,
+	"CRITICAL": 2,
+	"UNKNOWN":  3,
+}
+
+//promMetricName sanitizes an alias into a valid Prometheus metric name,
+//see https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+func promMetricName(alias string) string {
+	var b strings.Builder
+	for i, r := range alias {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return "nscrestc_" + b.String()
+}
+
+//writePromTextfile renders perfdata as a Prometheus node_exporter textfile
+//collector file and writes it to path via a temp-file + rename so readers
+//never observe a partially written file. Entries without their own Command
+//(the single-query case) are labeled with defaultCommand.
+//
+//Entries are grouped by their sanitized metric name before rendering: the
+//exposition format requires exactly one HELP/TYPE block per metric name, and
+//recurring aliases (e.g. "used", "free") are common across different
+//NSClient++ commands, especially once batch mode combines their perfdata
+//into a single file.
+func writePromTextfile(path, defaultCommand, sourceID string, perfdata []Perfdata) error {
+	var names []string
+	groups := make(map[string][]Perfdata)
+	for _, p := range perfdata {
+		name := promMetricName(p.Alias)
+		if _, seen := groups[name]; !seen {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], p)
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		group := groups[name]
+		fmt.Fprintf(&buf, "# HELP %s NSClient++ perfdata for %q.\n", name, group[0].Alias)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		for _, p := range group {
+			command := p.Command
+			if command == "" {
+				command = defaultCommand
+			}
+			labels := fmt.Sprintf("command=%q,source_id=%q", command, sourceID)
+			fmt.Fprintf(&buf, "%s{%s} %s\n", name, labels, strconv.FormatFloat(p.Value, 'f', -1, 64))
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//parseParams turns "key=value" CLI arguments into url.Values, the way
+//nscrestc has always passed query parameters through to NSClient++.
+func parseParams(args []string) url.Values {
+	params := url.Values{}
+	for _, a := range args {
+		p := strings.SplitN(a, "=", 2)
+		if len(p) == 1 {
+			// FIXME it is unclear if a trailing "=" e.g. on show-all can lead to errors
+			params.Add(p[0], "")
+		} else {
+			params.Add(p[0], p[1])
+		}
+	}
+	return params
+}
+
+//nagiosPerfString renders perfdata entries as a Nagios plugin perfdata
+//string ("'label'=value[UOM];[warn];[crit];[min];[max] ..."), the same
+//format renderResult produces while decoding a single nsclient.Query.
+func nagiosPerfString(perfdata []Perfdata) string {
+	var buf bytes.Buffer
+	for _, p := range perfdata {
+		buf.WriteString(" '" + p.Alias + "'=" + strconv.FormatFloat(p.Value, 'f', -1, 64))
+		buf.WriteString(p.Unit)
+		if p.Warning != nil {
+			buf.WriteString(";" + strconv.FormatFloat(*p.Warning, 'f', -1, 64))
+		}
+		if p.Critical != nil {
+			buf.WriteString(";" + strconv.FormatFloat(*p.Critical, 'f', -1, 64))
+		}
+		if p.Minimum != nil {
+			buf.WriteString(";" + strconv.FormatFloat(*p.Minimum, 'f', -1, 64))
+		}
+		if p.Maximum != nil {
+			buf.WriteString(";" + strconv.FormatFloat(*p.Maximum, 'f', -1, 64))
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+//renderResult turns a decoded nsclient.Query into its response lines, a
+//Nagios perfdata string and a structured Perfdata slice, shared by the
+//single-query and batch code paths. Lines holds one entry per
+//Payload[0].Lines[].Message, in order, so callers that need the full
+//response (e.g. -o json) don't lose anything to NSClient++'s occasional
+//multi-line output.
+func renderResult(queryResult *nsclient.Query) (lines []string, nagiosPerf string, perfdata []Perfdata) {
+	var buf bytes.Buffer
+
+	// FIXME how to iterate the slice of lines safely ?
+	for _, l := range queryResult.Payload[0].Lines {
+
+		lines = append(lines, strings.TrimSpace(l.Message))
+
+		for _, p := range l.Perf {
+			// REFERENCE 'label'=value[UOM];[warn];[crit];[min];[max]
+			if p.IntValue.Value != nil {
+				buf.WriteString(" '" + p.Alias + "'=" + strconv.FormatFloat(*(p.IntValue.Value), 'f', -1, 64))
+			} else {
+				continue
+			}
+			entry := Perfdata{Alias: p.Alias, Value: *(p.IntValue.Value)}
+			if p.IntValue.Unit != nil {
+				buf.WriteString(*(p.IntValue.Unit))
+				entry.Unit = *(p.IntValue.Unit)
+			}
+			if p.IntValue.Warning != nil {
+				buf.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Warning), 'f', -1, 64))
+				entry.Warning = p.IntValue.Warning
+			}
+			if p.IntValue.Critical != nil {
+				buf.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Critical), 'f', -1, 64))
+				entry.Critical = p.IntValue.Critical
+			}
+			if p.IntValue.Minimum != nil {
+				buf.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Minimum), 'f', -1, 64))
+				entry.Minimum = p.IntValue.Minimum
+			}
+			if p.IntValue.Maximum != nil {
+				buf.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Maximum), 'f', -1, 64))
+				entry.Maximum = p.IntValue.Maximum
+			}
+			perfdata = append(perfdata, entry)
+		}
+	}
+
+	return lines, strings.TrimSpace(buf.String()), perfdata
 }
 
 func main() {
@@ -70,19 +299,33 @@ func main() {
 	var flagTimeout int
 	var flagVerbose bool
 	var flagInsecure bool
+	var flagOutput string
+	var flagPromTextfile string
+	var flagCert string
+	var flagKey string
+	var flagCA string
+	var flagCiphers string
+	var flagMinTLS string
+	var flagBatchFile string
+	var flagParallel int
+	var flagSubmit string
 
 	flag.StringVar(&flagURL, "u", "", "NSCLient++ URL, for example https://10.1.2.3:8443.")
 	flag.StringVar(&flagPassword, "p", "", "NSClient++ webserver password.")
 	flag.IntVar(&flagTimeout, "t", 10, "Connection timeout in seconds, defaults to 10.")
 	flag.BoolVar(&flagVerbose, "v", false, "Enable verbose output.")
 	flag.BoolVar(&flagInsecure, "k", false, "Insecure mode - skip TLS verification.")
-
-	ReturncodeMap := map[string]int{
-		"OK":       0,
-		"WARNING":  1,
-		"CRITICAL": 2,
-		"UNKNOWN":  3,
-	}
+	flag.StringVar(&flagOutput, "o", "nagios", "Output format: \"nagios\" (default, message|perfdata) or \"json\" (structured result/message/perfdata document).")
+	flag.StringVar(&flagOutput, "output", "nagios", "Long form of -o.")
+	flag.StringVar(&flagPromTextfile, "prom-textfile", "", "If set, additionally write the perfdata as Prometheus node_exporter textfile metrics to this path (atomically).")
+	flag.StringVar(&flagCert, "C", "", "Client certificate file (PEM) for mutual TLS, requires -K.")
+	flag.StringVar(&flagKey, "K", "", "Client private key file (PEM) for mutual TLS, requires -C.")
+	flag.StringVar(&flagCA, "A", "", "CA bundle file (PEM) to verify the server certificate against, instead of the system pool.")
+	flag.StringVar(&flagCiphers, "ciphers", "", "Comma-separated list of IANA TLS cipher suite names to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.")
+	flag.StringVar(&flagMinTLS, "min-tls", "", "Minimum TLS version to negotiate: \"1.2\" or \"1.3\".")
+	flag.StringVar(&flagBatchFile, "b", "", "Batch mode: file with one \"command key=value ...\" query spec per line, run over a single shared HTTP client.")
+	flag.IntVar(&flagParallel, "parallel", 1, "Number of batch queries to run concurrently, only used with -b.")
+	flag.StringVar(&flagSubmit, "submit", "", "Submit the result as an NRDP passive check instead of printing it, e.g. nrdp://host:port?token=...&host=...&service=...")
 
 	flag.Parse()
 	seen := make(map[string]bool)
@@ -98,133 +341,143 @@ func main() {
 		}
 	}
 
-	urlStruct, err := url.Parse(flagURL)
-	if err != nil {
-		fmt.Println("UNKNOWN: " + err.Error())
-		os.Exit(3)
+	var submitTarget *nrdpTarget
+	if flagSubmit != "" {
+		var err error
+		submitTarget, err = parseNRDPTarget(flagSubmit)
+		if err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
+		}
 	}
 
-	if len(flag.Args()) == 0 {
-		urlStruct.Path += "/"
-	} else if len(flag.Args()) == 1 {
-		urlStruct.Path += "/query/" + flag.Arg(0)
-	} else {
-		urlStruct.Path += "/query/" + flag.Arg(0)
-		parameters := url.Values{}
-		for i, a := range flag.Args() {
-			if i == 0 {
-				continue
-			}
-			p := strings.SplitN(a, "=", 2)
-			if len(p) == 1 {
-				// FIXME it is unclear if a trailing "=" e.g. on show-all can lead to errors
-				parameters.Add(p[0], "")
-			} else {
-				parameters.Add(p[0], p[1])
+	opts := []nsclient.Option{
+		nsclient.WithTimeout(time.Second * time.Duration(flagTimeout)),
+	}
+
+	if flagCA != "" || flagCiphers != "" || flagMinTLS != "" {
+		tlsConfig := &tls.Config{}
+		if flagCA != "" {
+			pool, err := loadCABundle(flagCA)
+			if err != nil {
+				fmt.Println("UNKNOWN: " + err.Error())
+				os.Exit(3)
 			}
+			tlsConfig.RootCAs = pool
+		}
+		if flagCiphers != "" {
+			suites, err := buildCipherSuites(flagCiphers)
 			if err != nil {
 				fmt.Println("UNKNOWN: " + err.Error())
 				os.Exit(3)
 			}
+			tlsConfig.CipherSuites = suites
+		}
+		if flagMinTLS != "" {
+			version, ok := tlsVersions[flagMinTLS]
+			if !ok {
+				fmt.Printf("UNKNOWN: Unsupported --min-tls %q, expected \"1.2\" or \"1.3\"\n", flagMinTLS)
+				os.Exit(3)
+			}
+			tlsConfig.MinVersion = version
 		}
-		urlStruct.RawQuery = parameters.Encode()
+		opts = append(opts, nsclient.WithTLSConfig(tlsConfig))
 	}
-
-	var hTransport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: flagInsecure,
-		},
-		TLSHandshakeTimeout: time.Second * time.Duration(flagTimeout),
+	if flagCert != "" || flagKey != "" {
+		if flagCert == "" || flagKey == "" {
+			fmt.Println("UNKNOWN: -C and -K must be given together")
+			os.Exit(3)
+		}
+		opts = append(opts, nsclient.WithClientCert(flagCert, flagKey))
+	}
+	if flagInsecure {
+		opts = append(opts, nsclient.WithInsecure())
 	}
-	var hClient = &http.Client{
-		Timeout:   time.Second * time.Duration(flagTimeout),
-		Transport: hTransport,
+	if flagVerbose {
+		opts = append(opts, nsclient.WithVerbose(os.Stdout))
 	}
 
-	req, err := http.NewRequest("GET", urlStruct.String(), nil)
+	client, err := nsclient.NewClient(flagURL, flagPassword, opts...)
 	if err != nil {
 		fmt.Println("UNKNOWN: " + err.Error())
 		os.Exit(3)
 	}
-	req.Header.Add("password", flagPassword)
 
-	if flagVerbose {
-		dumpreq, err := httputil.DumpRequestOut(req, true)
-		if err != nil {
-			fmt.Printf("REQUEST-ERROR:\n%s\n", err.Error())
+	ctx := context.Background()
+
+	if flagBatchFile != "" {
+		runBatch(ctx, client, flagBatchFile, flagParallel, flagOutput, flagPromTextfile, submitTarget)
+		return
+	}
+
+	if len(flag.Args()) == 0 {
+		if err := client.Ping(ctx); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
 		}
-		fmt.Printf("REQUEST:\n%q\n", dumpreq)
+		fmt.Println("OK: NSClient API reachable on " + flagURL)
+		os.Exit(0)
 	}
-	res, err := hClient.Do(req)
+
+	parameters := parseParams(flag.Args()[1:])
+
+	queryResult, err := client.Query(ctx, flag.Arg(0), parameters)
 	if err != nil {
+		if flagVerbose {
+			fmt.Printf("QUERY RESULT:\n%+v\n", queryResult)
+		}
 		fmt.Println("UNKNOWN: " + err.Error())
 		os.Exit(3)
 	}
-	defer res.Body.Close()
+	result := queryResult.Payload[0].Result
+	lines, nagiosPerf, perfdata := renderResult(queryResult)
+	fullMessage := strings.Join(lines, "\n")
+	var nagiosMessage string
+	if len(lines) > 0 {
+		nagiosMessage = lines[len(lines)-1]
+	}
 
-	if flagVerbose {
-		dumpres, err := httputil.DumpResponse(res, true)
-		if err != nil {
-			fmt.Printf("RESPONSE-ERROR:\n%s\n", err.Error())
+	if flagPromTextfile != "" {
+		command := queryResult.Payload[0].Command
+		if err := writePromTextfile(flagPromTextfile, command, queryResult.Header.SourceID, perfdata); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
 		}
-		fmt.Printf("RESPONSE:\n%q\n", dumpres)
 	}
 
-	if len(flag.Args()) == 0 {
-		fmt.Println("OK: NSClient API reachable on " + flagURL)
+	if submitTarget != nil {
+		output := fullMessage
+		if nagiosPerf != "" {
+			output += "|" + nagiosPerf
+		}
+		if err := submitTarget.submit(ctx, client.HTTPClient(), ReturncodeMap[result], output); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
+		}
+		fmt.Println("OK: submitted " + result + " result for " + submitTarget.hostname + " to NRDP")
 		os.Exit(0)
-	} else {
-		queryResult := new(Query)
-		json.NewDecoder(res.Body).Decode(queryResult)
+	}
 
-		if len(queryResult.Payload) == 0 {
-			if flagVerbose {
-				fmt.Printf("QUERY RESULT:\n%+v\n", queryResult)
-			}
-			fmt.Println("UNKNOWN: The resultpayload size is 0")
-			os.Exit(3)
+	switch flagOutput {
+	case "json":
+		jsonResult := JSONResult{
+			Result:   result,
+			ExitCode: ReturncodeMap[result],
+			Message:  fullMessage,
+			Lines:    lines,
+			Perfdata: perfdata,
 		}
-		result := queryResult.Payload[0].Result
-
-		var nagiosMessage string
-		var nagiosPerfdata bytes.Buffer
-
-		// FIXME how to iterate the slice of lines safely ?
-		for _, l := range queryResult.Payload[0].Lines {
-
-			nagiosMessage = strings.TrimSpace(l.Message)
-
-			for _, p := range l.Perf {
-				// REFERENCE 'label'=value[UOM];[warn];[crit];[min];[max]
-				if p.IntValue.Value != nil {
-					nagiosPerfdata.WriteString(" '" + p.Alias + "'=" + strconv.FormatFloat(*(p.IntValue.Value), 'f', -1, 64))
-				} else {
-					continue
-				}
-				if p.IntValue.Unit != nil {
-					nagiosPerfdata.WriteString(*(p.IntValue.Unit))
-				}
-				if p.IntValue.Warning != nil {
-					nagiosPerfdata.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Warning), 'f', -1, 64))
-				}
-				if p.IntValue.Critical != nil {
-					nagiosPerfdata.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Critical), 'f', -1, 64))
-				}
-				if p.IntValue.Minimum != nil {
-					nagiosPerfdata.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Minimum), 'f', -1, 64))
-				}
-				if p.IntValue.Maximum != nil {
-					nagiosPerfdata.WriteString(";" + strconv.FormatFloat(*(p.IntValue.Maximum), 'f', -1, 64))
-				}
-			}
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(jsonResult); err != nil {
+			fmt.Println("UNKNOWN: " + err.Error())
+			os.Exit(3)
 		}
-
-		if nagiosPerfdata.Len() == 0 {
+	default:
+		if nagiosPerf == "" {
 			fmt.Println(nagiosMessage)
 		} else {
-			fmt.Println(nagiosMessage + "|" + strings.TrimSpace(nagiosPerfdata.String()))
+			fmt.Println(nagiosMessage + "|" + nagiosPerf)
 		}
-		os.Exit(ReturncodeMap[result])
 	}
-
+	os.Exit(ReturncodeMap[result])
 }
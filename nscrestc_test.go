@@ -0,0 +1,150 @@
+/*
+  nscrestc
+
+  Copyright 2016 Michael Kraus <Michael.Kraus@consol.de>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Griesbacher/nscrestc/pkg/nsclient"
+)
+
+//mustDecodeQuery decodes rawJSON the same way nsclient.Client.Query does,
+//so renderResult tests exercise it against the same shape the real
+//NSClient++ responses arrive in.
+func mustDecodeQuery(t *testing.T, rawJSON string) *nsclient.Query {
+	t.Helper()
+	q := new(nsclient.Query)
+	if err := json.Unmarshal([]byte(rawJSON), q); err != nil {
+		t.Fatalf("decoding fixture: %v", err)
+	}
+	return q
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestRenderResult(t *testing.T) {
+	cases := []struct {
+		name        string
+		rawJSON     string
+		wantLines   []string
+		wantPerfLen int
+		wantNagPerf string
+	}{
+		{
+			name: "single line with perfdata",
+			rawJSON: `{"payload":[{"command":"check_cpu","result":"OK","lines":[
+				{"message":"CPU load is ok","perf":[
+					{"alias":"total","int_value":{"value":5,"unit":"%"}}
+				]}
+			]}]}`,
+			wantLines:   []string{"CPU load is ok"},
+			wantPerfLen: 1,
+			wantNagPerf: "'total'=5%",
+		},
+		{
+			name: "multiple lines are not lossy",
+			rawJSON: `{"payload":[{"command":"check_drivesize","result":"OK","lines":[
+				{"message":"first line"},
+				{"message":"second line"}
+			]}]}`,
+			wantLines:   []string{"first line", "second line"},
+			wantPerfLen: 0,
+			wantNagPerf: "",
+		},
+		{
+			name: "perf entry without a value is skipped",
+			rawJSON: `{"payload":[{"command":"check_cpu","result":"OK","lines":[
+				{"message":"no value here","perf":[
+					{"alias":"total","int_value":{}}
+				]}
+			]}]}`,
+			wantLines:   []string{"no value here"},
+			wantPerfLen: 0,
+			wantNagPerf: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lines, nagiosPerf, perfdata := renderResult(mustDecodeQuery(t, c.rawJSON))
+			if strings.Join(lines, "\n") != strings.Join(c.wantLines, "\n") {
+				t.Errorf("lines = %v, want %v", lines, c.wantLines)
+			}
+			if len(perfdata) != c.wantPerfLen {
+				t.Errorf("got %d perfdata entries, want %d", len(perfdata), c.wantPerfLen)
+			}
+			if nagiosPerf != c.wantNagPerf {
+				t.Errorf("nagiosPerf = %q, want %q", nagiosPerf, c.wantNagPerf)
+			}
+		})
+	}
+}
+
+func TestNagiosPerfString(t *testing.T) {
+	cases := []struct {
+		name     string
+		perfdata []Perfdata
+		want     string
+	}{
+		{
+			name:     "empty",
+			perfdata: nil,
+			want:     "",
+		},
+		{
+			name:     "value only",
+			perfdata: []Perfdata{{Alias: "used", Value: 42}},
+			want:     "'used'=42",
+		},
+		{
+			name: "full thresholds",
+			perfdata: []Perfdata{{
+				Alias:    "used",
+				Value:    42,
+				Unit:     "%",
+				Warning:  floatPtr(80),
+				Critical: floatPtr(90),
+				Minimum:  floatPtr(0),
+				Maximum:  floatPtr(100),
+			}},
+			want: "'used'=42%;80;90;0;100",
+		},
+		{
+			name: "multiple entries",
+			perfdata: []Perfdata{
+				{Alias: "used", Value: 1},
+				{Alias: "free", Value: 2},
+			},
+			want: "'used'=1 'free'=2",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := nagiosPerfString(c.perfdata); got != c.want {
+				t.Errorf("nagiosPerfString(%+v) = %q, want %q", c.perfdata, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/*
+  nscrestc
+
+  Copyright 2016 Michael Kraus <Michael.Kraus@consol.de>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+//Package nsclient is a small client library for the NSClient++ REST/web
+//server, used by the nscrestc CLI but usable on its own from other Go
+//programs (custom checks, exporters, test harnesses).
+package nsclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+//defaultTimeout is used when no WithTimeout option is supplied.
+const defaultTimeout = 10 * time.Second
+
+//Query represents the nsclient response to a /query/<command> request.
+type Query struct {
+	Header struct {
+		SourceID string `json:"source_id"`
+	} `json:"header"`
+	Payload []struct {
+		Command string `json:"command"`
+		Lines   []struct {
+			Message string `json:"message"`
+			Perf    []struct {
+				Alias    string `json:"alias"`
+				IntValue struct {
+					Value    *float64 `json:"value,omitempty"`
+					Unit     *string  `json:"unit,omitempty"`
+					Warning  *float64 `json:"warning,omitempty"`
+					Critical *float64 `json:"critical,omitempty"`
+					Minimum  *float64 `json:"mininum,omitempty"`
+					Maximum  *float64 `json:"maximum,omitempty"`
+				} `json:"int_value"`
+			} `json:"perf"`
+		} `json:"lines"`
+		Result string `json:"result"`
+	} `json:"payload"`
+}
+
+//Client talks to a single NSClient++ instance.
+type Client struct {
+	baseURL    *url.URL
+	password   string
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	debug      io.Writer
+	initErr    error
+}
+
+//Option configures a Client. Options are applied in the order given to
+//NewClient, so a later option can override an earlier one (e.g. a custom
+//WithHTTPClient after WithTimeout).
+type Option func(*Client)
+
+//WithTimeout sets the request and TLS handshake timeout. Defaults to 10s.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = d
+		if t, ok := c.httpClient.Transport.(*http.Transport); ok {
+			t.TLSHandshakeTimeout = d
+		}
+	}
+}
+
+//WithInsecure disables TLS certificate verification.
+func WithInsecure() Option {
+	return func(c *Client) {
+		c.tlsConfig.InsecureSkipVerify = true
+	}
+}
+
+//WithTLSConfig replaces the client's TLS config outright, for callers that
+//need full control (custom RootCAs, cipher suites, client certificates).
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+		if t, ok := c.httpClient.Transport.(*http.Transport); ok {
+			t.TLSClientConfig = cfg
+		}
+	}
+}
+
+//WithClientCert loads an X509 keypair from certFile/keyFile and presents it
+//to the server for mutual TLS.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(c *Client) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			c.initErr = err
+			return
+		}
+		c.tlsConfig.Certificates = append(c.tlsConfig.Certificates, cert)
+	}
+}
+
+//WithHTTPClient replaces the underlying http.Client wholesale, e.g. to
+//inject a custom Transport or share one across multiple Clients. A
+//WithTLSConfig applied after it installs its config on hc's Transport only
+//if that Transport is an *http.Transport; WithInsecure and WithClientCert
+//change the Client's own TLS config, not the one hc's Transport uses.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+//WithVerbose dumps every outgoing request and incoming response to w, the
+//way the CLI's -v flag used to do inline.
+func WithVerbose(w io.Writer) Option {
+	return func(c *Client) {
+		c.debug = w
+	}
+}
+
+//NewClient builds a Client for the NSClient++ webserver at baseURL,
+//authenticating with password. baseURL is something like
+//"https://10.1.2.3:8443".
+func NewClient(baseURL, password string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	c := &Client{
+		baseURL:  u,
+		password: password,
+		httpClient: &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: defaultTimeout,
+			},
+		},
+		tlsConfig: tlsConfig,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.initErr != nil {
+		return nil, c.initErr
+	}
+
+	return c, nil
+}
+
+//HTTPClient returns the *http.Client backing this Client, configured with
+//whatever timeout, TLS and certificate options were passed to NewClient.
+//Embedders that need to make a related request (e.g. submitting the result
+//somewhere else) can reuse it instead of re-deriving the same TLS setup.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+//newRequest builds a GET request against path with the password header set.
+func (c *Client) newRequest(ctx context.Context, path string, params url.Values) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path += path
+	if params != nil {
+		u.RawQuery = params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("password", c.password)
+	return req, nil
+}
+
+//do sends req, dumping it and its response when verbose logging is enabled.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.debug != nil {
+		if dump, err := httputil.DumpRequestOut(req, true); err != nil {
+			fmt.Fprintf(c.debug, "REQUEST-ERROR:\n%s\n", err.Error())
+		} else {
+			fmt.Fprintf(c.debug, "REQUEST:\n%q\n", dump)
+		}
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.debug != nil {
+		if dump, err := httputil.DumpResponse(res, true); err != nil {
+			fmt.Fprintf(c.debug, "RESPONSE-ERROR:\n%s\n", err.Error())
+		} else {
+			fmt.Fprintf(c.debug, "RESPONSE:\n%q\n", dump)
+		}
+	}
+	return res, nil
+}
+
+//Query runs command (e.g. "check_cpu") with params against the NSClient++
+//REST API and decodes the resulting payload.
+func (c *Client) Query(ctx context.Context, command string, params url.Values) (*Query, error) {
+	req, err := c.newRequest(ctx, "/query/"+command, params)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	query := new(Query)
+	if err := json.NewDecoder(res.Body).Decode(query); err != nil {
+		return nil, fmt.Errorf("decoding nsclient response: %w", err)
+	}
+	if len(query.Payload) == 0 {
+		return query, fmt.Errorf("the result payload size is 0")
+	}
+	return query, nil
+}
+
+//Ping checks that the NSClient++ webserver is reachable and answering.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "/", nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
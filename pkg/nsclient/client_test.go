@@ -0,0 +1,126 @@
+/*
+  nscrestc
+
+  Copyright 2016 Michael Kraus <Michael.Kraus@consol.de>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nsclient
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewClientOptions(t *testing.T) {
+	c, err := NewClient("https://10.1.2.3:8443", "secret", WithTimeout(5*time.Second), WithInsecure())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if c.httpClient.Timeout != 5*time.Second {
+		t.Errorf("httpClient.Timeout = %v, want 5s", c.httpClient.Timeout)
+	}
+	if !c.tlsConfig.InsecureSkipVerify {
+		t.Error("WithInsecure did not set InsecureSkipVerify")
+	}
+}
+
+func TestNewClientBadCertFails(t *testing.T) {
+	_, err := NewClient("https://10.1.2.3:8443", "secret", WithClientCert("does-not-exist.crt", "does-not-exist.key"))
+	if err == nil {
+		t.Fatal("expected NewClient to fail on a missing client cert, got nil error")
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	const body = `{"header":{"source_id":"host1"},"payload":[{"command":"check_cpu","result":"OK","lines":[{"message":"load ok"}]}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("password") != "secret" {
+			t.Errorf("missing/wrong password header: %q", r.Header.Get("password"))
+		}
+		if r.URL.Path != "/query/check_cpu" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, "secret")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	query, err := c.Query(context.Background(), "check_cpu", nil)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if query.Header.SourceID != "host1" {
+		t.Errorf("SourceID = %q, want host1", query.Header.SourceID)
+	}
+	if len(query.Payload) != 1 || query.Payload[0].Result != "OK" {
+		t.Fatalf("unexpected payload: %+v", query.Payload)
+	}
+}
+
+func TestClientQueryEmptyPayloadIsAnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"header":{"source_id":"host1"},"payload":[]}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, "secret")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if _, err := c.Query(context.Background(), "check_cpu", nil); err == nil {
+		t.Fatal("expected an error for an empty payload, got nil")
+	}
+}
+
+func TestWithVerboseDumpsRequestAndResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"payload":[{"command":"check_cpu","result":"OK","lines":[{"message":"ok"}]}]}`))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	c, err := NewClient(srv.URL, "secret", WithVerbose(&buf))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := c.Query(context.Background(), "check_cpu", nil); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+
+	if !bytes.Contains(buf.Bytes(), []byte("REQUEST:")) || !bytes.Contains(buf.Bytes(), []byte("RESPONSE:")) {
+		t.Errorf("WithVerbose did not dump request/response, got: %s", buf.String())
+	}
+}
+
+func TestHTTPClientReturnsConfiguredClient(t *testing.T) {
+	hc := &http.Client{Timeout: 42 * time.Second}
+	c, err := NewClient("https://10.1.2.3:8443", "secret", WithHTTPClient(hc))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if c.HTTPClient() != hc {
+		t.Error("HTTPClient() did not return the http.Client passed via WithHTTPClient")
+	}
+}